@@ -0,0 +1,252 @@
+package main
+
+/**********************************************
+ * admin.go: a small HTTP admin API, bound to localhost only, for poking at
+ * a running ambex without going through SIGHUP and without having to
+ * guess what it's actually serving. Everything here just reads or drives
+ * the same SnapshotCaches and `update` that the file watcher uses.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+
+	cachev2 "github.com/envoyproxy/go-control-plane/pkg/cache/v2"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var adminPort uint
+
+func init() {
+	flag.UintVar(&adminPort, "admin-port", 0, "Admin HTTP port (0 disables the admin API)")
+}
+
+// admin wires the admin HTTP API to the bits of ambex it reports on and
+// can drive: the two SnapshotCaches, the generation counter and resource
+// versioner `update` uses, and the dirs `update` reads from.
+type admin struct {
+	configV2   cachev2.SnapshotCache
+	configV3   cachev3.SnapshotCache
+	generation *int
+	versioner  *bucketVersioner
+	dirs       []string
+
+	// updateMu serializes calls to `update`, whether they come from the
+	// file watcher, SIGHUP, or a POST /reload, so two reloads can't race
+	// and interleave writes to *generation and the versioner.
+	updateMu *sync.Mutex
+}
+
+func newAdmin(configV2 cachev2.SnapshotCache, configV3 cachev3.SnapshotCache, generation *int, versioner *bucketVersioner, dirs []string, updateMu *sync.Mutex) *admin {
+	return &admin{
+		configV2:   configV2,
+		configV3:   configV3,
+		generation: generation,
+		versioner:  versioner,
+		dirs:       dirs,
+		updateMu:   updateMu,
+	}
+}
+
+// nodeDump is what GET /config/dump returns for a single node ID. We dump
+// resource *names* rather than full bodies -- the files on disk are the
+// source of truth for content, this is about seeing what's being served.
+// Each resource type has its own version since bucketVersioner tracks (and
+// SetSnapshot is given) one version per type, not one for the whole node.
+type nodeDump struct {
+	NodeID           string   `json:"node_id"`
+	APIVersion       string   `json:"api_version"`
+	ClustersVersion  string   `json:"clusters_version"`
+	EndpointsVersion string   `json:"endpoints_version"`
+	RoutesVersion    string   `json:"routes_version"`
+	ListenersVersion string   `json:"listeners_version"`
+	Clusters         []string `json:"clusters,omitempty"`
+	Endpoints        []string `json:"endpoints,omitempty"`
+	Routes           []string `json:"routes,omitempty"`
+	Listeners        []string `json:"listeners,omitempty"`
+}
+
+func (a *admin) handleConfigDump(w http.ResponseWriter, r *http.Request) {
+	var dumps []nodeDump
+
+	for _, nodeID := range a.configV2.GetStatusKeys() {
+		snapshot, err := a.configV2.GetSnapshot(nodeID)
+		if err != nil {
+			continue
+		}
+		dump := nodeDump{
+			NodeID:           nodeID,
+			APIVersion:       "v2",
+			ClustersVersion:  snapshot.Clusters.Version,
+			EndpointsVersion: snapshot.Endpoints.Version,
+			RoutesVersion:    snapshot.Routes.Version,
+			ListenersVersion: snapshot.Listeners.Version,
+		}
+		for name := range snapshot.Clusters.Items {
+			dump.Clusters = append(dump.Clusters, name)
+		}
+		for name := range snapshot.Endpoints.Items {
+			dump.Endpoints = append(dump.Endpoints, name)
+		}
+		for name := range snapshot.Routes.Items {
+			dump.Routes = append(dump.Routes, name)
+		}
+		for name := range snapshot.Listeners.Items {
+			dump.Listeners = append(dump.Listeners, name)
+		}
+		dumps = append(dumps, dump)
+	}
+
+	for _, nodeID := range a.configV3.GetStatusKeys() {
+		snapshot, err := a.configV3.GetSnapshot(nodeID)
+		if err != nil {
+			continue
+		}
+		dump := nodeDump{
+			NodeID:           nodeID,
+			APIVersion:       "v3",
+			ClustersVersion:  snapshot.Clusters.Version,
+			EndpointsVersion: snapshot.Endpoints.Version,
+			RoutesVersion:    snapshot.Routes.Version,
+			ListenersVersion: snapshot.Listeners.Version,
+		}
+		for name := range snapshot.Clusters.Items {
+			dump.Clusters = append(dump.Clusters, name)
+		}
+		for name := range snapshot.Endpoints.Items {
+			dump.Endpoints = append(dump.Endpoints, name)
+		}
+		for name := range snapshot.Routes.Items {
+			dump.Routes = append(dump.Routes, name)
+		}
+		for name := range snapshot.Listeners.Items {
+			dump.Listeners = append(dump.Listeners, name)
+		}
+		dumps = append(dumps, dump)
+	}
+
+	writeJSON(w, http.StatusOK, dumps)
+}
+
+type snapshotSummary struct {
+	NodeID           string `json:"node_id"`
+	APIVersion       string `json:"api_version"`
+	ClustersVersion  string `json:"clusters_version"`
+	EndpointsVersion string `json:"endpoints_version"`
+	RoutesVersion    string `json:"routes_version"`
+	ListenersVersion string `json:"listeners_version"`
+}
+
+func (a *admin) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	var summaries []snapshotSummary
+
+	for _, nodeID := range a.configV2.GetStatusKeys() {
+		summaries = append(summaries, snapshotSummary{
+			NodeID:           nodeID,
+			APIVersion:       "v2",
+			ClustersVersion:  a.versioner.versionFor(nodeID + "/v2/clusters"),
+			EndpointsVersion: a.versioner.versionFor(nodeID + "/v2/endpoints"),
+			RoutesVersion:    a.versioner.versionFor(nodeID + "/v2/routes"),
+			ListenersVersion: a.versioner.versionFor(nodeID + "/v2/listeners"),
+		})
+	}
+	for _, nodeID := range a.configV3.GetStatusKeys() {
+		summaries = append(summaries, snapshotSummary{
+			NodeID:           nodeID,
+			APIVersion:       "v3",
+			ClustersVersion:  a.versioner.versionFor(nodeID + "/v3/clusters"),
+			EndpointsVersion: a.versioner.versionFor(nodeID + "/v3/endpoints"),
+			RoutesVersion:    a.versioner.versionFor(nodeID + "/v3/routes"),
+			ListenersVersion: a.versioner.versionFor(nodeID + "/v3/listeners"),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (a *admin) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.updateMu.Lock()
+	result := update(a.configV2, a.configV3, a.generation, a.versioner, a.dirs)
+	a.updateMu.Unlock()
+
+	status := http.StatusOK
+	if !result.OK {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, result)
+}
+
+func (a *admin) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *admin) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	// We're ready once at least one update has run (the initial load counts
+	// whether or not it pushed anything). *a.generation is only ever mutated
+	// under updateMu (by update, via Server.Reload or POST /reload), so we
+	// take the same lock here rather than racing a concurrent reload.
+	a.updateMu.Lock()
+	ready := *a.generation > 0
+	a.updateMu.Unlock()
+
+	if ready {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, "not ready")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error encoding admin response")
+	}
+}
+
+// runAdminServer starts the admin HTTP API on localhost:port, if port is
+// nonzero. Like runManagementServer, it's torn down when ctx is done.
+func runAdminServer(ctx context.Context, a *admin, port uint) {
+	if port == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config/dump", a.handleConfigDump)
+	mux.HandleFunc("/snapshots", a.handleSnapshots)
+	mux.HandleFunc("/reload", a.handleReload)
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", localhost, port),
+		Handler: mux,
+	}
+
+	log.WithFields(log.Fields{"port": port}).Info("Admin API listening")
+	go func() {
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.WithError(err).Error("Admin server exited")
+			}
+		}()
+
+		<-ctx.Done()
+		srv.Close()
+	}()
+}
@@ -21,9 +21,11 @@ package main
  * - The gRPC stuff is handled by a Server.
  *   - import github.com/envoyproxy/go-control-plane/pkg/server, then refer
  *     to server.Server.
- *   - Our runManagementServer (largely ripped off from the go-control-plane
- *     tests) gets this running. It takes a SnapshotCache (cleverly called a
- *     "config" for no reason I understand) and a gRPCServer as arguments.
+ *   - Our Server type (see server.go, largely ripped off from the
+ *     go-control-plane tests) gets this running. NewServer takes the config
+ *     dirs and ports; the Server builds its own v2/v3 SnapshotCaches
+ *     (cleverly called a "config" for no reason I understand) and its own
+ *     gRPCServer.
  *   - _ALL_ the gRPC madness is handled by the Server, with the assistance
  *     of the methods in a callback object.
  * - Once the Server is running, Envoy can open a gRPC stream to it.
@@ -36,13 +38,18 @@ package main
  *   - By default when we get a SIGHUP, we reload configuration.
  *   - When passed the -watch argument we reload whenever any file in
  *     the directory changes.
+ *
+ * As of this writing, Envoy is in the middle of dropping the v2 xDS API in
+ * favor of v3, so we speak both: a v2 SnapshotCache/Server pair and a v3
+ * SnapshotCache/Server pair, fed from the same on-disk config. Which cache a
+ * given resource lands in is decided by its `Any.TypeUrl`, not by which
+ * directory it came from.
  */
 
 import (
 	"context"
 	"flag"
 	"fmt"
-	"net"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -50,16 +57,18 @@ import (
 	"strings"
 	"syscall"
 
-	"google.golang.org/grpc"
-
 	log "github.com/sirupsen/logrus"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	"github.com/envoyproxy/go-control-plane/pkg/cache"
-	"github.com/envoyproxy/go-control-plane/pkg/server"
+	cachev2 "github.com/envoyproxy/go-control-plane/pkg/cache/v2"
 
-	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 
 	"github.com/fsnotify/fsnotify"
 
@@ -70,6 +79,10 @@ import (
 
 const (
 	localhost  = "127.0.0.1"
+	// defaultNodeID is the snapshot key used for resources that aren't
+	// grouped under a per-node directory (i.e. files living directly in
+	// one of the watched dirs), so single-Envoy setups keep working.
+	defaultNodeID = "test-id"
 )
 
 var (
@@ -84,7 +97,7 @@ func init() {
 	flag.BoolVar(&watch, "watch", false, "Watch for file changes")
 }
 
-// Hasher returns node ID as an ID
+// Hasher returns node ID as an ID, for the v2 SnapshotCache.
 type Hasher struct {
 }
 
@@ -98,6 +111,21 @@ func (h Hasher) ID(node *core.Node) string {
 
 // end Hasher stuff
 
+// HasherV3 is Hasher's v3 counterpart; go-control-plane keeps the core.Node
+// type versioned, so the NodeHash implementations have to be versioned too.
+type HasherV3 struct {
+}
+
+// ID function
+func (h HasherV3) ID(node *corev3.Node) string {
+	if node == nil {
+		return "unknown"
+	}
+	return node.Id
+}
+
+// end HasherV3 stuff
+
 // This feels kinda dumb.
 type logger struct{}
 
@@ -110,38 +138,6 @@ func (logger logger) Errorf(format string, args ...interface{}) {
 
 // end logger stuff
 
-// run stuff
-// RunManagementServer starts an xDS server at the given port.
-func runManagementServer(ctx context.Context, server server.Server, port uint) {
-	grpcServer := grpc.NewServer()
-
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.WithError(err).Fatal("failed to listen")
-	}
-
-	// register services
-	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, server)
-	v2.RegisterEndpointDiscoveryServiceServer(grpcServer, server)
-	v2.RegisterClusterDiscoveryServiceServer(grpcServer, server)
-	v2.RegisterRouteDiscoveryServiceServer(grpcServer, server)
-	v2.RegisterListenerDiscoveryServiceServer(grpcServer, server)
-
-	log.WithFields(log.Fields{"port": port}).Info("Listening")
-	go func() {
-		go func() {
-			err := grpcServer.Serve(lis)
-
-			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Error("Management server exited")
-			}
-		}()
-
-		<-ctx.Done()
-		grpcServer.GracefulStop()
-	}()
-}
-
 // Decoders for unmarshalling our config
 var decoders = map[string](func(string, proto.Message) error) {
 	".json": jsonpb.UnmarshalString,
@@ -165,6 +161,11 @@ type Validatable interface {
 	Validate() error
 }
 
+// decode returns the decoded resource and a nil error on success. On
+// failure the message is nil too, except in one case: if the resource
+// decoded fine but failed Validate(), we still hand back the concrete
+// (invalid) message so the caller can at least tell which xDS API version
+// it belongs to, instead of being left to guess.
 func decode(name string) (proto.Message, error) {
 	any := &types.Any{}
 	contents, err := ioutil.ReadFile(name)
@@ -182,73 +183,265 @@ func decode(name string) (proto.Message, error) {
 	var v = m.Message.(Validatable)
 
 	err = v.Validate()
-	if err != nil { return nil, err }
+	if err != nil { return v, err }
 	log.Infof("Loaded file %s", name)
 	return v, nil
 }
 
-func update(config cache.SnapshotCache, generation *int, dirs []string) {
-	clusters := []cache.Resource{} // v2.Cluster
-	endpoints := []cache.Resource{} // v2.ClusterLoadAssignment
-	routes := []cache.Resource{} // v2.RouteConfiguration
-	listeners := []cache.Resource{} // v2.Listener
+// nodeBucket accumulates the resources destined for a single node ID,
+// split by xDS API version since a v2 Cluster and a v3 Cluster are
+// different Go types and belong in different caches.
+type nodeBucket struct {
+	clustersV2  []cachev2.Resource
+	endpointsV2 []cachev2.Resource
+	routesV2    []cachev2.Resource
+	listenersV2 []cachev2.Resource
+
+	clustersV3  []cachev3.Resource
+	endpointsV3 []cachev3.Resource
+	routesV3    []cachev3.Resource
+	listenersV3 []cachev3.Resource
+}
+
+func newNodeBucket() *nodeBucket {
+	return &nodeBucket{}
+}
+
+// addResource files a decoded resource into the right slice of the right
+// node's bucket, based on its concrete (versioned) type.
+func (b *nodeBucket) addResource(m proto.Message) bool {
+	switch r := m.(type) {
+	case *v2.Cluster:
+		b.clustersV2 = append(b.clustersV2, r)
+	case *v2.ClusterLoadAssignment:
+		b.endpointsV2 = append(b.endpointsV2, r)
+	case *v2.RouteConfiguration:
+		b.routesV2 = append(b.routesV2, r)
+	case *v2.Listener:
+		b.listenersV2 = append(b.listenersV2, r)
+	case *clusterv3.Cluster:
+		b.clustersV3 = append(b.clustersV3, r)
+	case *endpointv3.ClusterLoadAssignment:
+		b.endpointsV3 = append(b.endpointsV3, r)
+	case *routev3.RouteConfiguration:
+		b.routesV3 = append(b.routesV3, r)
+	case *listenerv3.Listener:
+		b.listenersV3 = append(b.listenersV3, r)
+	default:
+		return false
+	}
+	return true
+}
 
-	var filenames []string
+// apiVersionOf reports which xDS API version a decoded resource belongs to
+// ("v2" or "v3"), or "" if m is nil or an unrecognized type -- i.e. when a
+// file failed to decode so badly (unparseable JSON/protobuf, or an
+// unregistered type URL) that we never got as far as a concrete message.
+func apiVersionOf(m proto.Message) string {
+	switch m.(type) {
+	case *v2.Cluster, *v2.ClusterLoadAssignment, *v2.RouteConfiguration, *v2.Listener:
+		return "v2"
+	case *clusterv3.Cluster, *endpointv3.ClusterLoadAssignment, *routev3.RouteConfiguration, *listenerv3.Listener:
+		return "v3"
+	default:
+		return ""
+	}
+}
+
+// findFiles walks dirs one level deep: a decodable file sitting directly in
+// a dir belongs to defaultNodeID, while a subdirectory names the node ID
+// that its contents belong to (dirs[i]/<node-id>/*).
+func findFiles(dirs []string) map[string][]string {
+	byNode := map[string][]string{}
 
 	for _, dir := range dirs {
-		files, err := ioutil.ReadDir(dir)
+		entries, err := ioutil.ReadDir(dir)
 		if err != nil {
-			log.WithError(err).Warn("Error listing %v", dir)
+			log.WithError(err).Warnf("Error listing %v", dir)
 			continue
 		}
-		for _, file := range files {
-			name := file.Name()
-			if isDecodable(name) {
-				filenames = append(filenames, filepath.Join(dir, name))
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				nodeID := name
+				nodeDir := filepath.Join(dir, name)
+				nodeEntries, err := ioutil.ReadDir(nodeDir)
+				if err != nil {
+					log.WithError(err).Warnf("Error listing %v", nodeDir)
+					continue
+				}
+				for _, nodeEntry := range nodeEntries {
+					if isDecodable(nodeEntry.Name()) {
+						byNode[nodeID] = append(byNode[nodeID], filepath.Join(nodeDir, nodeEntry.Name()))
+					}
+				}
+			} else if isDecodable(name) {
+				byNode[defaultNodeID] = append(byNode[defaultNodeID], filepath.Join(dir, name))
 			}
 		}
 	}
 
-	for _, name := range filenames {
-		m, e := decode(name)
-		if e != nil {
-			log.Warnf("%s: %v", name, e)
-			continue
-		}
-		var dst *[]cache.Resource
-		switch m.(type) {
-		case *v2.Cluster:
-			dst = &clusters
-		case *v2.ClusterLoadAssignment:
-			dst = &endpoints
-		case *v2.RouteConfiguration:
-			dst = &routes
-		case *v2.Listener:
-			dst = &listeners
-		default:
-			log.Warnf("Unrecognized resource %s: %v", name, e)
-			continue
+	return byNode
+}
+
+func update(configV2 cachev2.SnapshotCache, configV3 cachev3.SnapshotCache, generation *int, versioner *bucketVersioner, dirs []string) *UpdateResult {
+	result := newUpdateResult(*generation)
+	buckets := map[string]*nodeBucket{}
+	// bad is keyed by "<nodeID>/v2" / "<nodeID>/v3", not just nodeID, so a
+	// bad file only pins the API version(s) it could actually have
+	// affected. A file that fails to decode still tells us its API
+	// version when the failure was Validate() rejecting an otherwise
+	// well-formed resource (see decode); only a failure bad enough that we
+	// never got a concrete message (unparseable JSON/protobuf, unknown
+	// type URL) is ambiguous enough to pin both.
+	bad := map[string]bool{}
+
+	for nodeID, filenames := range findFiles(dirs) {
+		bucket := newNodeBucket()
+		for _, name := range filenames {
+			m, e := decode(name)
+			if e != nil {
+				log.Warnf("%s: %v", name, e)
+				result.addFileError(name, e)
+				switch apiVersionOf(m) {
+				case "v2":
+					bad[nodeID+"/v2"] = true
+				case "v3":
+					bad[nodeID+"/v3"] = true
+				default:
+					bad[nodeID+"/v2"] = true
+					bad[nodeID+"/v3"] = true
+				}
+				continue
+			}
+			if !bucket.addResource(m) {
+				log.Warnf("Unrecognized resource %s: %T", name, m)
+			}
 		}
-		*dst = append(*dst, m.(cache.Resource))
+		buckets[nodeID] = bucket
 	}
 
-	version := fmt.Sprintf("v%d", *generation)
+	// Only actually used as a resource or resource-type's new version when
+	// its content changed since the last generation; see bucketVersioner.
+	// SoTW clients always get the full bucket regardless, so they don't
+	// need to care either way.
+	candidate := fmt.Sprintf("v%d", *generation)
 	*generation++
-	snapshot := cache.NewSnapshot(version, endpoints, clusters, routes, listeners)
 
-	err := snapshot.Consistent()
+	for nodeID, bucket := range buckets {
+		// v2 and v3 are handled independently: a hashing or consistency
+		// error in one must not stop the other from being pushed for the
+		// same node, so neither branch below may skip past the other
+		// (e.g. via a bare `continue` in this outer loop).
+		if len(bucket.clustersV2)+len(bucket.endpointsV2)+len(bucket.routesV2)+len(bucket.listenersV2) > 0 {
+			key := nodeID + "/v2"
+			if bad[key] {
+				log.Warnf("Keeping last-good v2 snapshot for node %s: one or more files failed to load", nodeID)
+				result.addRejected(key)
+			} else if clustersVersion, endpointsVersion, routesVersion, listenersVersion, err := versionBucketV2(versioner, key, bucket, candidate); err != nil {
+				log.Errorf("Hashing v2 bucket for node %s: %v", nodeID, err)
+				result.addConsistencyError(key, err)
+				result.addRejected(key)
+			} else {
+				snapshot := cachev2.NewSnapshot(candidate, bucket.endpointsV2, bucket.clustersV2, bucket.routesV2, bucket.listenersV2)
+				snapshot.Clusters.Version = clustersVersion
+				snapshot.Endpoints.Version = endpointsVersion
+				snapshot.Routes.Version = routesVersion
+				snapshot.Listeners.Version = listenersVersion
+				if err := snapshot.Consistent(); err != nil {
+					log.Errorf("v2 snapshot inconsistency for node %s: %+v", nodeID, snapshot)
+					result.addConsistencyError(key, err)
+					result.addRejected(key)
+				} else if err := configV2.SetSnapshot(nodeID, snapshot); err != nil {
+					log.Fatalf("v2 snapshot error %q for node %s: %+v", err, nodeID, snapshot)
+				} else {
+					log.Infof("v2 snapshot for node %s: clusters=%s endpoints=%s routes=%s listeners=%s", nodeID, clustersVersion, endpointsVersion, routesVersion, listenersVersion)
+				}
+			}
+		}
 
-	if err != nil {
-		log.Errorf("Snapshot inconsistency: %+v", snapshot)
-	} else {
-		err = config.SetSnapshot("test-id", snapshot)
+		if len(bucket.clustersV3)+len(bucket.endpointsV3)+len(bucket.routesV3)+len(bucket.listenersV3) > 0 {
+			key := nodeID + "/v3"
+			if bad[key] {
+				log.Warnf("Keeping last-good v3 snapshot for node %s: one or more files failed to load", nodeID)
+				result.addRejected(key)
+			} else if clustersVersion, endpointsVersion, routesVersion, listenersVersion, err := versionBucketV3(versioner, key, bucket, candidate); err != nil {
+				log.Errorf("Hashing v3 bucket for node %s: %v", nodeID, err)
+				result.addConsistencyError(key, err)
+				result.addRejected(key)
+			} else {
+				snapshot := cachev3.NewSnapshot(candidate, bucket.endpointsV3, bucket.clustersV3, bucket.routesV3, bucket.listenersV3)
+				snapshot.Clusters.Version = clustersVersion
+				snapshot.Endpoints.Version = endpointsVersion
+				snapshot.Routes.Version = routesVersion
+				snapshot.Listeners.Version = listenersVersion
+				if err := snapshot.Consistent(); err != nil {
+					log.Errorf("v3 snapshot inconsistency for node %s: %+v", nodeID, snapshot)
+					result.addConsistencyError(key, err)
+					result.addRejected(key)
+				} else if err := configV3.SetSnapshot(nodeID, snapshot); err != nil {
+					log.Fatalf("v3 snapshot error %q for node %s: %+v", err, nodeID, snapshot)
+				} else {
+					log.Infof("v3 snapshot for node %s: clusters=%s endpoints=%s routes=%s listeners=%s", nodeID, clustersVersion, endpointsVersion, routesVersion, listenersVersion)
+				}
+			}
+		}
 	}
 
-	if err != nil {
-		log.Fatalf("Snapshot error %q for %+v", err, snapshot)
-	} else {
-		log.Infof("Snapshot %+v", snapshot)
+	writeStatusFile(statusFile, result)
+	return result
+}
+
+// versionBucketV2 computes the per-type versions for one node's v2 bucket,
+// keyed under key+"/clusters" etc. so unchanged types (and, within them,
+// unchanged individual resources -- see bucketVersioner) keep their old
+// version instead of bumping on every reload.
+func versionBucketV2(versioner *bucketVersioner, key string, bucket *nodeBucket, candidate string) (clusters, endpoints, routes, listeners string, err error) {
+	if clusters, err = collectionVersion(versioner, key+"/clusters", toMessagesV2(bucket.clustersV2), candidate); err != nil {
+		return
+	}
+	if endpoints, err = collectionVersion(versioner, key+"/endpoints", toMessagesV2(bucket.endpointsV2), candidate); err != nil {
+		return
+	}
+	if routes, err = collectionVersion(versioner, key+"/routes", toMessagesV2(bucket.routesV2), candidate); err != nil {
+		return
+	}
+	listeners, err = collectionVersion(versioner, key+"/listeners", toMessagesV2(bucket.listenersV2), candidate)
+	return
+}
+
+// versionBucketV3 is versionBucketV2's v3 counterpart.
+func versionBucketV3(versioner *bucketVersioner, key string, bucket *nodeBucket, candidate string) (clusters, endpoints, routes, listeners string, err error) {
+	if clusters, err = collectionVersion(versioner, key+"/clusters", toMessagesV3(bucket.clustersV3), candidate); err != nil {
+		return
+	}
+	if endpoints, err = collectionVersion(versioner, key+"/endpoints", toMessagesV3(bucket.endpointsV3), candidate); err != nil {
+		return
+	}
+	if routes, err = collectionVersion(versioner, key+"/routes", toMessagesV3(bucket.routesV3), candidate); err != nil {
+		return
+	}
+	listeners, err = collectionVersion(versioner, key+"/listeners", toMessagesV3(bucket.listenersV3), candidate)
+	return
+}
+
+// toMessagesV2 and toMessagesV3 upcast one resource-type slice from a
+// bucket to []proto.Message for hashing; cache{v2,v3}.Resource is just a
+// proto.Message under the hood, so the cast is safe.
+func toMessagesV2(rs []cachev2.Resource) []proto.Message {
+	var out []proto.Message
+	for _, r := range rs {
+		out = append(out, r.(proto.Message))
+	}
+	return out
+}
+
+func toMessagesV3(rs []cachev3.Resource) []proto.Message {
+	var out []proto.Message
+	for _, r := range rs {
+		out = append(out, r.(proto.Message))
 	}
+	return out
 }
 
 func warn(err error) bool {
@@ -279,7 +472,9 @@ func main() {
 
 	if watch {
 		for _, d := range dirs {
-			watcher.Add(d)
+			if err := addWatchesRecursive(watcher, d); err != nil {
+				log.WithError(err).Warnf("Error watching %s", d)
+			}
 		}
 	}
 
@@ -289,10 +484,11 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	config := cache.NewSnapshotCache(true, Hasher{}, logger{})
-	srv := server.NewServer(config, nil)
-
-	runManagementServer(ctx, srv, adsPort)
+	srv, err := NewServer(dirs, adsPort, adminPort)
+	if err != nil {
+		log.WithError(err).Fatal("failed to listen")
+	}
+	defer srv.Stop()
 
 	pid := os.Getpid()
 	file := "ambex.pid"
@@ -300,8 +496,15 @@ func main() {
 		log.WithFields(log.Fields{"pid": pid, "file": file}).Info("Wrote PID")
 	}
 
-	generation := 0
-	update(config, &generation, dirs)
+	initial := srv.Start(ctx)
+	if !initial.OK {
+		if strict {
+			log.Fatalf("Initial config is invalid: %+v", initial)
+		}
+		log.Errorf("Initial config is invalid, serving whatever loaded cleanly: %+v", initial)
+	}
+
+	debounce := newDebouncer(watchDebounce)
 
 	OUTER: for {
 
@@ -309,12 +512,21 @@ func main() {
 		case sig := <- ch:
 			switch sig {
 			case syscall.SIGHUP:
-				update(config, &generation, dirs)
+				srv.Reload()
 			case os.Interrupt, syscall.SIGTERM:
 				break OUTER
 			}
-		case <- watcher.Events:
-			update(config, &generation, dirs)
+		case event := <- watcher.Events:
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatchesRecursive(watcher, event.Name); err != nil {
+						log.WithError(err).Warnf("Error watching new directory %s", event.Name)
+					}
+				}
+			}
+			debounce.Reset()
+		case <- debounce.C:
+			srv.Reload()
 		case err := <- watcher.Errors:
 			log.WithError(err).Warn("Watcher error")
 		}
@@ -0,0 +1,209 @@
+package main
+
+/**********************************************
+ * main_test.go: drives a Server over a real gRPC connection, the same way
+ * Envoy would, instead of shelling out to the ambex binary and pointing a
+ * real Envoy at it.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// clusterFixture is the smallest valid v3 Cluster JSON we can write to
+// disk for decode() to pick up.
+const clusterFixture = `{
+	"@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+	"name": "%s",
+	"connect_timeout": "5s",
+	"type": "STATIC",
+	"lb_policy": "ROUND_ROBIN"
+}`
+
+func writeCluster(t *testing.T, dir, nodeID, name string) {
+	t.Helper()
+	nodeDir := filepath.Join(dir, nodeID)
+	if err := os.MkdirAll(nodeDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	path := filepath.Join(nodeDir, name+".json")
+	contents := []byte(fmt.Sprintf(clusterFixture, name))
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// startTestServer starts a Server on an ephemeral port rooted at a fresh
+// tempdir, and returns it along with that tempdir. Teardown is registered
+// with t.Cleanup.
+func startTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	srv, err := NewServer([]string{dir}, 0, 0)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		srv.Stop()
+	})
+	return srv, dir
+}
+
+// dialADS connects a real v3 ADS client to srv, as Envoy would, with the
+// given node ID.
+func dialADS(t *testing.T, srv *Server, nodeID string) discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesClient {
+	t.Helper()
+	conn, err := grpc.Dial(srv.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := discoveryv3.NewAggregatedDiscoveryServiceClient(conn)
+	stream, err := client.StreamAggregatedResources(context.Background())
+	if err != nil {
+		t.Fatalf("StreamAggregatedResources: %v", err)
+	}
+
+	req := &discoveryv3.DiscoveryRequest{
+		Node:    &corev3.Node{Id: nodeID},
+		TypeUrl: "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	return stream
+}
+
+func recvWithTimeout(t *testing.T, stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesClient) *discoveryv3.DiscoveryResponse {
+	t.Helper()
+	type result struct {
+		resp *discoveryv3.DiscoveryResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := stream.Recv()
+		ch <- result{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Recv: %v", r.err)
+		}
+		return r.resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for DiscoveryResponse")
+		return nil
+	}
+}
+
+func TestInitialSnapshotDelivery(t *testing.T) {
+	srv, dir := startTestServer(t)
+	writeCluster(t, dir, "node-a", "cluster-1")
+	result := srv.Reload()
+	if !result.OK {
+		t.Fatalf("Reload failed: %+v", result)
+	}
+
+	stream := dialADS(t, srv, "node-a")
+	resp := recvWithTimeout(t, stream)
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected 1 resource, got %d", len(resp.Resources))
+	}
+	if resp.VersionInfo == "" {
+		t.Fatal("expected a non-empty version")
+	}
+}
+
+func TestReloadBumpsVersion(t *testing.T) {
+	srv, dir := startTestServer(t)
+	writeCluster(t, dir, "node-a", "cluster-1")
+	srv.Reload()
+
+	stream := dialADS(t, srv, "node-a")
+	first := recvWithTimeout(t, stream)
+
+	writeCluster(t, dir, "node-a", "cluster-2")
+	srv.Reload()
+
+	second := recvWithTimeout(t, stream)
+	if second.VersionInfo == first.VersionInfo {
+		t.Fatalf("expected version to change, stayed at %s", first.VersionInfo)
+	}
+	if len(second.Resources) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(second.Resources))
+	}
+}
+
+func TestReloadValidationFailurePreservesSnapshot(t *testing.T) {
+	srv, dir := startTestServer(t)
+	writeCluster(t, dir, "node-a", "cluster-1")
+	srv.Reload()
+
+	stream := dialADS(t, srv, "node-a")
+	good := recvWithTimeout(t, stream)
+
+	badPath := filepath.Join(dir, "node-a", "broken.json")
+	if err := ioutil.WriteFile(badPath, []byte("{not valid json"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	result := srv.Reload()
+	if result.OK {
+		t.Fatal("expected Reload to report a failure")
+	}
+
+	if len(good.Resources) != 1 {
+		t.Fatalf("sanity check: expected 1 resource before the bad reload, got %d", len(good.Resources))
+	}
+
+	// The whole point of rejecting the bad reload is that node-a keeps
+	// being served its last-good snapshot, not an empty or partial one.
+	// Open a fresh stream rather than reusing `stream`: a new ADS stream
+	// always gets sent whatever the cache currently holds for this node
+	// on connect, so this proves what's actually being served now, not
+	// just what was in flight before the bad reload.
+	after := dialADS(t, srv, "node-a")
+	stillGood := recvWithTimeout(t, after)
+	if len(stillGood.Resources) != 1 {
+		t.Fatalf("expected node-a to still serve 1 resource after the bad reload, got %d", len(stillGood.Resources))
+	}
+	if stillGood.VersionInfo != good.VersionInfo {
+		t.Fatalf("expected node-a's version to be unchanged after the bad reload, was %s now %s", good.VersionInfo, stillGood.VersionInfo)
+	}
+}
+
+func TestPerNodeIsolation(t *testing.T) {
+	srv, dir := startTestServer(t)
+	writeCluster(t, dir, "node-a", "a-cluster")
+	writeCluster(t, dir, "node-b", "b-cluster")
+	srv.Reload()
+
+	streamA := dialADS(t, srv, "node-a")
+	respA := recvWithTimeout(t, streamA)
+	if len(respA.Resources) != 1 {
+		t.Fatalf("node-a: expected 1 resource, got %d", len(respA.Resources))
+	}
+
+	streamB := dialADS(t, srv, "node-b")
+	respB := recvWithTimeout(t, streamB)
+	if len(respB.Resources) != 1 {
+		t.Fatalf("node-b: expected 1 resource, got %d", len(respB.Resources))
+	}
+}
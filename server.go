@@ -0,0 +1,139 @@
+package main
+
+/**********************************************
+ * server.go: the testable core of ambex, pulled out of main() so it can be
+ * driven directly from Go tests instead of only by shelling out to the
+ * built binary and pointing a real Envoy at it.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	cachev2 "github.com/envoyproxy/go-control-plane/pkg/cache/v2"
+	serverv2 "github.com/envoyproxy/go-control-plane/pkg/server/v2"
+
+	discoveryv2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// Server bundles up everything needed to run ambex's ADS + admin APIs, so
+// tests can construct one, Start it on an ephemeral port, drive it with
+// Reload, and Stop it -- no subprocess required.
+type Server struct {
+	SnapshotCacheV2 cachev2.SnapshotCache
+	SnapshotCacheV3 cachev3.SnapshotCache
+	GRPCServer      *grpc.Server
+	Dirs            []string
+	Generation      int
+
+	listener net.Listener
+	versioner *bucketVersioner
+	admin     *admin
+	adminPort uint
+
+	updateMu sync.Mutex
+	cancel    context.CancelFunc
+}
+
+// NewServer builds a Server and binds its ADS listener. adsPort 0 (like
+// net.Listen's own ":0" convention) picks an ephemeral free port, which is
+// what tests want; Addr() reports back what was actually bound.
+func NewServer(dirs []string, adsPort uint, adminPort uint) (*Server, error) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", adsPort))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		SnapshotCacheV2: cachev2.NewSnapshotCache(true, Hasher{}, logger{}),
+		SnapshotCacheV3: cachev3.NewSnapshotCache(true, HasherV3{}, logger{}),
+		Dirs:            dirs,
+		listener:        lis,
+		versioner:       newBucketVersioner(),
+		adminPort:       adminPort,
+	}, nil
+}
+
+// Addr returns the address the ADS gRPC listener is bound to.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start registers and serves the v2/v3 ADS services and the admin API (if
+// adminPort is nonzero), then performs the initial config load. The
+// returned UpdateResult reflects that initial load, same as main() uses
+// it to decide whether to exit non-zero.
+func (s *Server) Start(ctx context.Context) *UpdateResult {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	s.GRPCServer = grpc.NewServer()
+	srv2 := serverv2.NewServer(ctx, s.SnapshotCacheV2, nil)
+	srv3 := serverv3.NewServer(ctx, s.SnapshotCacheV3, nil)
+	registerServices(s.GRPCServer, srv2, srv3)
+
+	log.WithFields(log.Fields{"addr": s.listener.Addr()}).Info("Listening")
+	go func() {
+		if err := s.GRPCServer.Serve(s.listener); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Management server exited")
+		}
+	}()
+
+	s.admin = newAdmin(s.SnapshotCacheV2, s.SnapshotCacheV3, &s.Generation, s.versioner, s.Dirs, &s.updateMu)
+	runAdminServer(ctx, s.admin, s.adminPort)
+
+	return s.Reload()
+}
+
+// Reload re-reads Dirs and pushes whatever's valid to the SnapshotCaches,
+// same as a SIGHUP, a file-watch debounce firing, or a POST /reload would.
+func (s *Server) Reload() *UpdateResult {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	return update(s.SnapshotCacheV2, s.SnapshotCacheV3, &s.Generation, s.versioner, s.Dirs)
+}
+
+// Stop tears down the gRPC and admin servers and closes the ADS listener.
+func (s *Server) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.GRPCServer != nil {
+		s.GRPCServer.GracefulStop()
+	}
+}
+
+// registerServices wires the v2 and v3 ADS/xDS service handlers onto a
+// shared gRPC server. The v3 xxxDiscoveryServiceServer stubs bundle the
+// Stream*, Delta*, and Fetch* rpcs into one service definition, so this is
+// enough to serve Envoy's Delta/Incremental xDS as well as SoTW -- there's
+// no separate "delta server" to wire up.
+func registerServices(grpcServer *grpc.Server, srv2 serverv2.Server, srv3 serverv3.Server) {
+	discoveryv2.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv2)
+	v2.RegisterEndpointDiscoveryServiceServer(grpcServer, srv2)
+	v2.RegisterClusterDiscoveryServiceServer(grpcServer, srv2)
+	v2.RegisterRouteDiscoveryServiceServer(grpcServer, srv2)
+	v2.RegisterListenerDiscoveryServiceServer(grpcServer, srv2)
+
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv3)
+	clusterv3.RegisterClusterDiscoveryServiceServer(grpcServer, srv3)
+	endpointv3.RegisterEndpointDiscoveryServiceServer(grpcServer, srv3)
+	routev3.RegisterRouteDiscoveryServiceServer(grpcServer, srv3)
+	listenerv3.RegisterListenerDiscoveryServiceServer(grpcServer, srv3)
+}
@@ -0,0 +1,93 @@
+package main
+
+/**********************************************
+ * validate.go: a structured record of what happened during one `update`
+ * call, so a bad config push is visible (and rejected) instead of quietly
+ * degrading whatever ambex happens to be serving.
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	statusFile string
+	strict     bool
+)
+
+func init() {
+	flag.StringVar(&statusFile, "status-file", "", "Write the result of each reload, as JSON, to this path")
+	flag.BoolVar(&strict, "strict", false, "Exit non-zero if the initial config load is invalid, for CI-style one-shot validation runs. Does not affect later reloads (SIGHUP, -watch, POST /reload), which always keep serving the last-good snapshot on a bad push regardless of -strict")
+}
+
+// UpdateResult is what one call to `update` produced: which files failed
+// to parse or validate, which nodes' resources didn't form a consistent
+// snapshot, and -- derived from those -- whether the reload is good enough
+// to serve.
+type UpdateResult struct {
+	Generation int `json:"generation"`
+
+	// FileErrors maps a config file's path to the parse or Validate()
+	// error decoding it, for files that didn't make it into any bucket.
+	FileErrors map[string]string `json:"file_errors,omitempty"`
+
+	// ConsistencyErrors maps "<nodeID>/<apiVersion>" to the error from
+	// Snapshot.Consistent(), for buckets that parsed fine individually
+	// but don't hang together (e.g. a route referencing a missing
+	// cluster), or to the error from hashing the bucket's resources.
+	ConsistencyErrors map[string]string `json:"consistency_errors,omitempty"`
+
+	// RejectedNodes lists "<nodeID>/<apiVersion>" buckets that were NOT
+	// pushed to the cache because of the errors above; those nodes kept
+	// whatever snapshot they were already serving.
+	RejectedNodes []string `json:"rejected_nodes,omitempty"`
+
+	OK bool `json:"ok"`
+}
+
+func newUpdateResult(generation int) *UpdateResult {
+	return &UpdateResult{
+		Generation:        generation,
+		FileErrors:        map[string]string{},
+		ConsistencyErrors: map[string]string{},
+		OK:                true,
+	}
+}
+
+func (r *UpdateResult) addFileError(name string, err error) {
+	r.FileErrors[name] = err.Error()
+	r.OK = false
+}
+
+func (r *UpdateResult) addConsistencyError(key string, err error) {
+	r.ConsistencyErrors[key] = err.Error()
+	r.OK = false
+}
+
+func (r *UpdateResult) addRejected(key string) {
+	r.RejectedNodes = append(r.RejectedNodes, key)
+	r.OK = false
+}
+
+// writeStatusFile records the outcome of an update as JSON at path, for
+// operators who'd rather tail a file. The admin API does not read this
+// file; the only HTTP route that returns an UpdateResult is POST /reload,
+// for the reload it triggers. A failure to write it is logged but never
+// fatal -- the reload itself already succeeded or failed on its own merits.
+func writeStatusFile(path string, result *UpdateResult) {
+	if path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("Error marshalling status file")
+		return
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		log.WithError(err).Errorf("Error writing status file %s", path)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+/**********************************************
+ * versions.go: per-resource content hashing so `update` only bumps a
+ * version when something actually changed. Envoy's Delta/Incremental xDS
+ * protocol wants unchanged resources to keep their old version across
+ * generations (see the go-control-plane docs on "resource versioning");
+ * this is what lets us stop minting a brand new `v<generation>` for every
+ * file-watch event, even when the event turned out to be a no-op (e.g. a
+ * rename+replace that produced identical bytes).
+ *
+ * go-control-plane's own Delta xDS server implementation already hashes
+ * each resource's wire bytes when it builds a DeltaDiscoveryResponse, so a
+ * client speaking Delta xDS only ever receives resources whose bytes
+ * actually changed, regardless of what we do here. What bucketVersioner
+ * buys us on top of that: (a) a human-legible "vN" version per
+ * resource-type collection for the admin API and logs -- nobody wants to
+ * read a sha256 in /config/dump -- and (b) the ability to skip
+ * re-pushing a whole resource TYPE (e.g. "node X's v3
+ * clusters") when nothing in it changed, instead of treating every type
+ * in a node's bucket as one all-or-nothing blob.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+)
+
+// resourceName returns the name a resource is identified by for versioning
+// purposes -- its xDS resource name, which is also what Envoy uses to
+// request/ACK it. ClusterLoadAssignment is the odd one out: its identifying
+// field is cluster_name, not name.
+func resourceName(m proto.Message) string {
+	switch r := m.(type) {
+	case *v2.Cluster:
+		return r.GetName()
+	case *v2.ClusterLoadAssignment:
+		return r.GetClusterName()
+	case *v2.RouteConfiguration:
+		return r.GetName()
+	case *v2.Listener:
+		return r.GetName()
+	case *clusterv3.Cluster:
+		return r.GetName()
+	case *endpointv3.ClusterLoadAssignment:
+		return r.GetClusterName()
+	case *routev3.RouteConfiguration:
+		return r.GetName()
+	case *listenerv3.Listener:
+		return r.GetName()
+	default:
+		return ""
+	}
+}
+
+// hashResource returns a stable content hash for a decoded resource, so we
+// can tell whether it changed since the last generation without caring how
+// it changed (different file, different bytes, whatever).
+func hashResource(m proto.Message) (string, error) {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type versionedHash struct {
+	hash    string
+	version string
+}
+
+// bucketVersioner tracks two levels of "did this change": individual
+// resources (map key "<nodeID>/<apiVersion>/<type>/<name>") and whole
+// resource-type collections (map key "<nodeID>/<apiVersion>/<type>").
+// cache.Snapshot carries one version per type collection -- there's no
+// per-resource version slot to hand the SnapshotCache directly -- so
+// resourceVersion only decides typeVersion's "did anything in this type
+// change" input (per-resource versions are not reported by the admin API
+// or logs); typeVersion is what actually gets attached to the Snapshot.
+//
+// members records, per type-collection key, the set of resource names that
+// were present last time that collection was versioned. An edited or added
+// resource is caught by resourceVersion's hash comparison, but a *removed*
+// resource never goes through resourceVersion at all -- it just stops
+// showing up in the slice `collectionVersion` is called with -- so members
+// is what lets collectionVersion notice the collection shrank and bump its
+// version accordingly, instead of silently leaving an already-connected
+// SoTW watcher on a version string that still matches its last push.
+type bucketVersioner struct {
+	resources map[string]versionedHash
+	types     map[string]versionedHash
+	members   map[string]map[string]bool
+}
+
+func newBucketVersioner() *bucketVersioner {
+	return &bucketVersioner{
+		resources: map[string]versionedHash{},
+		types:     map[string]versionedHash{},
+		members:   map[string]map[string]bool{},
+	}
+}
+
+// resourceVersion returns the version to report for a single resource,
+// reusing its last version if its content hash is unchanged since the
+// last generation that saw it, and otherwise minting candidate. The
+// second return value says whether it actually changed, which callers
+// fold together to decide a whole type collection's version.
+func (bv *bucketVersioner) resourceVersion(key string, hash string, candidate string) (version string, changed bool) {
+	prev, ok := bv.resources[key]
+	if ok && prev.hash == hash {
+		return prev.version, false
+	}
+	bv.resources[key] = versionedHash{hash: hash, version: candidate}
+	return candidate, true
+}
+
+// typeVersion returns the version for a whole resource-type collection:
+// candidate if anyChanged (something in the collection is new, removed,
+// or edited), or the collection's last version if every member was
+// reused unchanged.
+func (bv *bucketVersioner) typeVersion(key string, anyChanged bool, candidate string) string {
+	if !anyChanged {
+		if prev, ok := bv.types[key]; ok {
+			return prev.version
+		}
+	}
+	bv.types[key] = versionedHash{version: candidate}
+	return candidate
+}
+
+// collectionVersion hashes every resource in a type collection (all of a
+// node's v3 clusters, say), updates bv's per-resource bookkeeping for each
+// one, and returns the version for the collection as a whole: candidate if
+// any resource in it is new, removed, or edited, otherwise the collection's
+// last version. typeKey is the "<nodeID>/<apiVersion>/<type>" prefix;
+// individual resources are tracked under typeKey+"/"+resourceName(m).
+func collectionVersion(bv *bucketVersioner, typeKey string, resources []proto.Message, candidate string) (string, error) {
+	current := make(map[string]bool, len(resources))
+	anyChanged := false
+
+	for _, m := range resources {
+		name := resourceName(m)
+		current[name] = true
+		hash, err := hashResource(m)
+		if err != nil {
+			return "", err
+		}
+		_, changed := bv.resourceVersion(typeKey+"/"+name, hash, candidate)
+		if changed {
+			anyChanged = true
+		}
+	}
+
+	// Anything present last time but missing from `current` was removed --
+	// forget its hash so a same-named resource added back later is treated
+	// as new rather than "unchanged since a version it was never part of".
+	for name := range bv.members[typeKey] {
+		if !current[name] {
+			anyChanged = true
+			delete(bv.resources, typeKey+"/"+name)
+		}
+	}
+	bv.members[typeKey] = current
+
+	return bv.typeVersion(typeKey, anyChanged, candidate), nil
+}
+
+// versionFor reports the version currently on file for a type-collection
+// key (an empty string if we've never served anything under that key),
+// for the admin API to report without needing its own copy of the
+// bookkeeping.
+func (bv *bucketVersioner) versionFor(key string) string {
+	return bv.types[key].version
+}
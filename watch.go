@@ -0,0 +1,78 @@
+package main
+
+/**********************************************
+ * watch.go: recursive directory watching and debounced reloads.
+ *
+ * fsnotify only watches the directories you explicitly Add(), not their
+ * subdirectories, so a layout with a subdirectory per node ID (see
+ * findFiles) needs every one of those subdirectories added individually,
+ * and newly-created ones added as they show up.
+ *
+ * Editors that write via rename+replace, and ConfigMap mounts that flip a
+ * `..data` symlink, each produce a burst of several Events for one
+ * logical change. Debouncing them into a single `update` avoids re-decoding
+ * every file on disk once per Event in the burst.
+ */
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+var watchDebounce time.Duration
+
+func init() {
+	flag.DurationVar(&watchDebounce, "watch-debounce", 250*time.Millisecond, "Quiet period to wait for a burst of file-watch events to settle before reloading")
+}
+
+// addWatchesRecursive walks root and adds every directory under it
+// (including root itself) to watcher.
+func addWatchesRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.WithError(err).Warnf("Error walking %s", path)
+			return nil
+		}
+		if info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				log.WithError(err).Warnf("Error watching %s", path)
+			}
+		}
+		return nil
+	})
+}
+
+// debouncer coalesces a burst of fsnotify events into a single signal,
+// delivered on C once events stop arriving for the configured quiet
+// period. Call Reset on every event; read C to know when to reload.
+type debouncer struct {
+	C     <-chan time.Time
+	timer *time.Timer
+	delay time.Duration
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{delay: delay}
+}
+
+// Reset (re)starts the quiet-period clock; each call pushes the eventual
+// fire time back by delay.
+func (d *debouncer) Reset() {
+	if d.timer == nil {
+		d.timer = time.NewTimer(d.delay)
+		d.C = d.timer.C
+		return
+	}
+	if !d.timer.Stop() {
+		select {
+		case <-d.timer.C:
+		default:
+		}
+	}
+	d.timer.Reset(d.delay)
+}